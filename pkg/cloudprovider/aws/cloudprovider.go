@@ -0,0 +1,35 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aws
+
+import (
+	"context"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+)
+
+// NewInstanceProviderForEC2API wires together the providers the AWS cloudprovider needs to
+// launch instances and hydrate their nodes: instance type and offering discovery, spot price
+// polling, and post-launch network topology labeling. spotPriceUpdateInterval of zero uses
+// DefaultSpotPriceUpdateInterval.
+func NewInstanceProviderForEC2API(ctx context.Context, ec2api ec2iface.EC2API, subnetProvider *SubnetProvider, pricingProvider *PricingProvider, spotPriceUpdateInterval time.Duration) *InstanceProvider {
+	spotPricingProvider := NewSpotPricingProvider(ec2api, spotPriceUpdateInterval)
+	instanceTopologyProvider := NewInstanceTopologyProvider(ec2api)
+	instanceTypeProvider := NewInstanceTypeProvider(ec2api, subnetProvider, pricingProvider, spotPricingProvider, instanceTopologyProvider)
+	spotPricingProvider.Start(ctx, instanceTypeProvider.KnownInstanceTypeZones)
+
+	return NewInstanceProvider(instanceTypeProvider, instanceTopologyProvider)
+}
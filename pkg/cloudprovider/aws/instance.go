@@ -0,0 +1,64 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aws
+
+import (
+	"context"
+
+	v1 "k8s.io/api/core/v1"
+	"knative.dev/pkg/logging"
+)
+
+// InstanceProvider hydrates a v1.Node with provider-specific labels once the EC2 instance behind
+// it has launched.
+type InstanceProvider struct {
+	instanceTypeProvider     *InstanceTypeProvider
+	instanceTopologyProvider *InstanceTopologyProvider
+}
+
+func NewInstanceProvider(instanceTypeProvider *InstanceTypeProvider, instanceTopologyProvider *InstanceTopologyProvider) *InstanceProvider {
+	return &InstanceProvider{
+		instanceTypeProvider:     instanceTypeProvider,
+		instanceTopologyProvider: instanceTopologyProvider,
+	}
+}
+
+// RegisterNode applies provider-specific labels discovered after launch to a node that has just
+// registered for the given instance: its network topology (best-effort; a resolution failure is
+// logged rather than failing registration) and its zone type (availability-zone, local-zone, or
+// wavelength-zone). A node only registers once CreateFleet has actually placed an instance in
+// this offering, so this is also where we tell the InstanceTypeProvider the offering is healthy
+// again, resetting any accumulated unavailability backoff for it.
+func (p *InstanceProvider) RegisterNode(ctx context.Context, node *v1.Node, instanceID, instanceType, zone, capacityType string) {
+	p.instanceTypeProvider.MarkAvailable(instanceType, zone, capacityType)
+
+	if node.Labels == nil {
+		node.Labels = map[string]string{}
+	}
+	if zoneType, ok := p.instanceTypeProvider.ZoneType(zone); ok {
+		node.Labels[ZoneTypeLabel] = zoneType
+	}
+
+	labelsByInstance, err := p.instanceTopologyProvider.Get(ctx, []instanceTopologyRequest{
+		{InstanceID: instanceID, InstanceType: instanceType, Zone: zone},
+	})
+	if err != nil {
+		logging.FromContext(ctx).Debugf("Unable to resolve network topology for %s, %s", instanceID, err)
+		return
+	}
+	for key, value := range labelsByInstance[instanceID] {
+		node.Labels[key] = value
+	}
+}
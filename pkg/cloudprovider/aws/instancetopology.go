@@ -0,0 +1,230 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aws
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/patrickmn/go-cache"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"knative.dev/pkg/logging"
+)
+
+const (
+	// NetworkNodeLayerLabelPrefix is the well-known label prefix under which the three levels of
+	// EC2's network node hierarchy (returned by DescribeInstanceTopology, ordered from the
+	// network node furthest from the instance to the rack-level node closest to it, so layer 3 is
+	// the rack-level node) are surfaced on a v1.Node, e.g.
+	// topology.k8s.aws/network-node-layer-1/2/3. Pods that benefit from same-rack placement (e.g.
+	// tightly-coupled HPC/ML workloads) can express affinity/anti-affinity against these keys.
+	NetworkNodeLayerLabelPrefix = "topology.k8s.aws/network-node-layer-"
+
+	// unsupportedInstanceFamiliesCacheTTL controls how long we avoid re-querying
+	// DescribeInstanceTopology for an instance family that EC2 has told us doesn't support it.
+	unsupportedInstanceFamiliesCacheTTL = 24 * time.Hour
+)
+
+// instanceTopologyRequest identifies a launched instance whose topology we want to resolve. Zone
+// is only used to record which zone a sibling instance landed in on a given network node; it
+// isn't sent to EC2.
+type instanceTopologyRequest struct {
+	InstanceID   string
+	InstanceType string
+	Zone         string
+}
+
+// InstanceTopologyProvider resolves the EC2 network topology (the set of network nodes an
+// instance sits behind) for launched instances, so it can be surfaced as scheduling labels on the
+// corresponding v1.Node during node registration. Results are cached for the lifetime of the
+// instance; instance families that EC2 reports as unsupported are tracked in a negative cache so
+// we stop asking about them.
+type InstanceTopologyProvider struct {
+	sync.Mutex
+	ec2api ec2iface.EC2API
+	// cache maps instance ID -> network node labels (keyed by NetworkNodeLayerLabelPrefix+"1/2/3")
+	cache *cache.Cache
+	// unsupportedInstanceFamilies tracks instance families (e.g. "p3") that EC2 has reported as
+	// not supporting DescribeInstanceTopology.
+	unsupportedInstanceFamilies *cache.Cache
+	// siblingZones maps <instanceType>:<rack-level network node> -> the zone the most recently
+	// launched sibling instance of that type landed in on that network node. InstanceTypeProvider
+	// consults this (via SiblingZones) to flag offerings in a zone a sibling is already in, as a
+	// topology-aware bin-packing hint.
+	siblingZones *cache.Cache
+}
+
+func NewInstanceTopologyProvider(ec2api ec2iface.EC2API) *InstanceTopologyProvider {
+	return &InstanceTopologyProvider{
+		ec2api:                      ec2api,
+		cache:                       cache.New(cache.NoExpiration, CacheCleanupInterval),
+		unsupportedInstanceFamilies: cache.New(unsupportedInstanceFamiliesCacheTTL, CacheCleanupInterval),
+		siblingZones:                cache.New(unsupportedInstanceFamiliesCacheTTL, CacheCleanupInterval),
+	}
+}
+
+func siblingZoneCacheKey(instanceType, networkNode string) string {
+	return fmt.Sprintf("%s:%s", instanceType, networkNode)
+}
+
+// SiblingZones returns every zone that a recently launched sibling of instanceType landed in, on
+// any rack-level network node. InstanceTypeProvider consults this when building offerings for
+// instanceType so it can flag the zones siblings are already in, giving the scheduler a
+// topology-aware bin-packing hint without needing to know which specific network node a pod
+// wants: all else equal, packing into a zone siblings are already in is more likely to land on
+// the same network node than a zone with no known siblings at all.
+func (p *InstanceTopologyProvider) SiblingZones(instanceType string) sets.String {
+	zones := sets.NewString()
+	prefix := instanceType + ":"
+	for key, item := range p.siblingZones.Items() {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if zone, ok := item.Object.(string); ok {
+			zones.Insert(zone)
+		}
+	}
+	return zones
+}
+
+// Get resolves the network topology labels for the given instances, batch-looking up any
+// instance that isn't already cached. Instances whose family is known to be unsupported are
+// silently omitted from the result, and instances for which EC2 returned no network node
+// information get an empty label set, rather than either being treated as an error, since
+// topology-aware placement is best-effort. Called from the
+// cloudprovider's node registration path once an instance has launched.
+func (p *InstanceTopologyProvider) Get(ctx context.Context, instances []instanceTopologyRequest) (map[string]map[string]string, error) {
+	p.Lock()
+	defer p.Unlock()
+
+	result := map[string]map[string]string{}
+	var toResolve []instanceTopologyRequest
+	for _, instance := range instances {
+		if labels, ok := p.cache.Get(instance.InstanceID); ok {
+			result[instance.InstanceID] = labels.(map[string]string)
+			continue
+		}
+		if _, unsupported := p.unsupportedInstanceFamilies.Get(instanceFamily(instance.InstanceType)); unsupported {
+			continue
+		}
+		toResolve = append(toResolve, instance)
+	}
+	if len(toResolve) == 0 {
+		return result, nil
+	}
+
+	resolved, err := p.getInstanceTopology(ctx, toResolve)
+	if err != nil {
+		return nil, fmt.Errorf("describing instance topology, %w", err)
+	}
+	for id, labels := range resolved {
+		p.cache.SetDefault(id, labels)
+		result[id] = labels
+	}
+	return result, nil
+}
+
+// getInstanceTopology pages through DescribeInstanceTopology for the given instances. Every
+// requested instance family is recorded in the negative cache only when the API reports
+// UnsupportedOperation; an instance that comes back without network node information gets an
+// empty label set and leaves its family's negative cache entry alone.
+func (p *InstanceTopologyProvider) getInstanceTopology(ctx context.Context, instances []instanceTopologyRequest) (map[string]map[string]string, error) {
+	instanceTypes := map[string]string{}
+	zones := map[string]string{}
+	ids := make([]string, 0, len(instances))
+	for _, instance := range instances {
+		ids = append(ids, instance.InstanceID)
+		instanceTypes[instance.InstanceID] = instance.InstanceType
+		zones[instance.InstanceID] = instance.Zone
+	}
+
+	result := map[string]map[string]string{}
+	seen := sets.NewString()
+	input := &ec2.DescribeInstanceTopologyInput{InstanceIds: aws.StringSlice(ids)}
+	for {
+		output, err := p.ec2api.DescribeInstanceTopologyWithContext(ctx, input)
+		if err != nil {
+			if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == "UnsupportedOperation" {
+				logging.FromContext(ctx).Debugf("DescribeInstanceTopology is unsupported, %s", awsErr.Message())
+				// The API isn't available at all for this region/account; every family we asked
+				// about is equally unsupported, so poison the negative cache for all of them.
+				for _, instanceType := range instanceTypes {
+					p.unsupportedInstanceFamilies.SetDefault(instanceFamily(instanceType), struct{}{})
+				}
+				return result, nil
+			}
+			return nil, err
+		}
+		for _, instance := range output.Instances {
+			id := aws.StringValue(instance.InstanceId)
+			seen.Insert(id)
+			nodes := aws.StringValueSlice(instance.NetworkNodes)
+			if len(nodes) == 0 {
+				continue
+			}
+			labels := map[string]string{}
+			for i, node := range nodes {
+				labels[fmt.Sprintf("%s%d", NetworkNodeLayerLabelPrefix, i+1)] = node
+			}
+			result[id] = labels
+			p.trackSiblingZone(instanceTypes[id], zones[id], labels)
+		}
+		if output.NextToken == nil {
+			break
+		}
+		input.NextToken = output.NextToken
+	}
+	// An instance we asked about but didn't get topology for could genuinely be in an unsupported
+	// family, or it could just be a transient gap (e.g. not in a cluster placement group) that
+	// says nothing about the rest of the family. We can't tell the two apart from this response
+	// alone, so don't poison unsupportedInstanceFamilies off of it; instead cache an empty result
+	// for just this instance ID so we don't re-query for it specifically, and let the next
+	// instance of the family resolve normally.
+	for id, instanceType := range instanceTypes {
+		if seen.Has(id) && result[id] != nil {
+			continue
+		}
+		logging.FromContext(ctx).Debugf("No network topology returned for instance %s (%s)", id, instanceType)
+		result[id] = map[string]string{}
+	}
+	return result, nil
+}
+
+// trackSiblingZone remembers the zone this instance landed in as the most recent sibling for its
+// instance type on its rack-level network node. SiblingZones reports these zones across all
+// network nodes of the instance type; it does not look up a specific network node.
+func (p *InstanceTopologyProvider) trackSiblingZone(instanceType, zone string, labels map[string]string) {
+	if zone == "" {
+		return
+	}
+	networkNode, ok := labels[NetworkNodeLayerLabelPrefix+"3"]
+	if !ok {
+		return
+	}
+	p.siblingZones.SetDefault(siblingZoneCacheKey(instanceType, networkNode), zone)
+}
+
+// instanceFamily returns the family (e.g. "p4d" from "p4d.24xlarge") an instance type belongs to,
+// which is the granularity at which DescribeInstanceTopology support varies.
+func instanceFamily(instanceType string) string {
+	return strings.SplitN(instanceType, ".", 2)[0]
+}
@@ -0,0 +1,117 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aws
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+)
+
+func TestInstanceFamily(t *testing.T) {
+	cases := []struct {
+		name         string
+		instanceType string
+		want         string
+	}{
+		{"standard type", "m5.large", "m5"},
+		{"metal type", "m5.metal", "m5"},
+		{"no size suffix", "m5", "m5"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := instanceFamily(c.instanceType); got != c.want {
+				t.Errorf("instanceFamily(%q) = %q, want %q", c.instanceType, got, c.want)
+			}
+		})
+	}
+}
+
+// fakeTopologyEC2API implements only the one ec2iface.EC2API method getInstanceTopology calls;
+// everything else panics if exercised, which a passing test shouldn't do.
+type fakeTopologyEC2API struct {
+	ec2iface.EC2API
+	output *ec2.DescribeInstanceTopologyOutput
+	err    error
+}
+
+func (f *fakeTopologyEC2API) DescribeInstanceTopologyWithContext(_ aws.Context, _ *ec2.DescribeInstanceTopologyInput, _ ...request.Option) (*ec2.DescribeInstanceTopologyOutput, error) {
+	return f.output, f.err
+}
+
+func TestGetInstanceTopologyBlanketUnsupportedPoisonsEveryFamily(t *testing.T) {
+	p := NewInstanceTopologyProvider(&fakeTopologyEC2API{err: awserr.New("UnsupportedOperation", "not available in this region", nil)})
+	_, err := p.getInstanceTopology(context.Background(), []instanceTopologyRequest{
+		{InstanceID: "i-1", InstanceType: "m5.large"},
+		{InstanceID: "i-2", InstanceType: "p3.2xlarge"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, ok := p.unsupportedInstanceFamilies.Get("m5"); !ok {
+		t.Errorf("expected m5 to be poisoned after a blanket UnsupportedOperation error")
+	}
+	if _, ok := p.unsupportedInstanceFamilies.Get("p3"); !ok {
+		t.Errorf("expected p3 to be poisoned after a blanket UnsupportedOperation error")
+	}
+}
+
+func TestGetInstanceTopologyMissingInstanceDoesNotPoisonFamily(t *testing.T) {
+	// EC2 returns nothing at all for i-2 (e.g. a transient gap), while i-1 of the same family
+	// resolves fine. That shouldn't generalize to "this family is unsupported".
+	p := NewInstanceTopologyProvider(&fakeTopologyEC2API{
+		output: &ec2.DescribeInstanceTopologyOutput{
+			Instances: []*ec2.InstanceTopology{
+				{InstanceId: aws.String("i-1"), NetworkNodes: aws.StringSlice([]string{"nn-1", "nn-2", "nn-3"})},
+			},
+		},
+	})
+	result, err := p.getInstanceTopology(context.Background(), []instanceTopologyRequest{
+		{InstanceID: "i-1", InstanceType: "m5.large"},
+		{InstanceID: "i-2", InstanceType: "m5.large"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, ok := p.unsupportedInstanceFamilies.Get("m5"); ok {
+		t.Errorf("a single instance missing topology data shouldn't poison the whole family's negative cache")
+	}
+	if len(result["i-1"]) == 0 {
+		t.Errorf("expected i-1 to resolve network topology labels")
+	}
+	if result["i-2"] == nil {
+		t.Errorf("expected i-2 to get a (empty) cached result so it isn't re-queried")
+	}
+}
+
+func TestSiblingZones(t *testing.T) {
+	p := NewInstanceTopologyProvider(nil)
+	p.trackSiblingZone("m5.large", "us-east-1a", map[string]string{NetworkNodeLayerLabelPrefix + "3": "nn-3"})
+	p.trackSiblingZone("m5.large", "us-east-1b", map[string]string{NetworkNodeLayerLabelPrefix + "3": "nn-4"})
+	p.trackSiblingZone("c5.large", "us-east-1c", map[string]string{NetworkNodeLayerLabelPrefix + "3": "nn-5"})
+
+	zones := p.SiblingZones("m5.large")
+	if !zones.Has("us-east-1a") || !zones.Has("us-east-1b") {
+		t.Errorf("expected SiblingZones(m5.large) to include both tracked zones, got %v", zones.List())
+	}
+	if zones.Has("us-east-1c") {
+		t.Errorf("expected SiblingZones(m5.large) not to include a different instance type's zone")
+	}
+}
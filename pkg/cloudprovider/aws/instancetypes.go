@@ -18,10 +18,12 @@ import (
 	"context"
 	"fmt"
 	"math"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
 	"github.com/mitchellh/hashstructure/v2"
@@ -32,21 +34,36 @@ import (
 
 	"github.com/aws/karpenter/pkg/cloudprovider"
 	"github.com/aws/karpenter/pkg/cloudprovider/aws/apis/v1alpha1"
+	"github.com/aws/karpenter/pkg/cloudprovider/aws/metrics"
 	"github.com/aws/karpenter/pkg/utils/functional"
 )
 
 const (
 	InstanceTypesCacheKey              = "types"
 	InstanceTypeZonesCacheKeyPrefix    = "zones:"
+	ZoneTypesCacheKey                  = "zone-types"
 	InstanceTypesAndZonesCacheTTL      = 5 * time.Minute
 	UnfulfillableCapacityErrorCacheTTL = 3 * time.Minute
+	// MaxUnfulfillableCapacityErrorCacheTTL caps how long an offering can be avoided for, no
+	// matter how many consecutive failures it has seen.
+	MaxUnfulfillableCapacityErrorCacheTTL = 1 * time.Hour
+
+	// ZoneTypeLabel is the well-known label that lets provisioners require or exclude edge zones
+	// (Local Zones, Wavelength Zones) instead of standard Availability Zones.
+	ZoneTypeLabel = "topology.k8s.aws/zone-type"
 )
 
+// locationTypes are the EC2 location types we enumerate offerings for, in addition to standard
+// Availability Zones, so that opted-in Local Zone and Wavelength Zone subnets are discoverable.
+var locationTypes = []string{"availability-zone", "local-zone", "wavelength-zone"}
+
 type InstanceTypeProvider struct {
 	sync.Mutex
-	ec2api          ec2iface.EC2API
-	subnetProvider  *SubnetProvider
-	pricingProvider *PricingProvider
+	ec2api                   ec2iface.EC2API
+	subnetProvider           *SubnetProvider
+	pricingProvider          *PricingProvider
+	spotPricingProvider      *SpotPricingProvider
+	instanceTopologyProvider *InstanceTopologyProvider
 	// Has one cache entry for all the instance types (key: InstanceTypesCacheKey)
 	// Has one cache entry for all the zones for each subnet selector (key: InstanceTypesZonesCacheKeyPrefix:<hash_of_selector>)
 	// Values cached *before* considering insufficient capacity errors from the unavailableOfferings cache.
@@ -55,18 +72,22 @@ type InstanceTypeProvider struct {
 	unavailableOfferings *cache.Cache
 }
 
-func NewInstanceTypeProvider(ec2api ec2iface.EC2API, subnetProvider *SubnetProvider, pricingProvider *PricingProvider) *InstanceTypeProvider {
+func NewInstanceTypeProvider(ec2api ec2iface.EC2API, subnetProvider *SubnetProvider, pricingProvider *PricingProvider, spotPricingProvider *SpotPricingProvider, instanceTopologyProvider *InstanceTopologyProvider) *InstanceTypeProvider {
 	return &InstanceTypeProvider{
-		ec2api:               ec2api,
-		subnetProvider:       subnetProvider,
-		pricingProvider:      pricingProvider,
-		cache:                cache.New(InstanceTypesAndZonesCacheTTL, CacheCleanupInterval),
-		unavailableOfferings: cache.New(UnfulfillableCapacityErrorCacheTTL, CacheCleanupInterval),
+		ec2api:                   ec2api,
+		subnetProvider:           subnetProvider,
+		pricingProvider:          pricingProvider,
+		spotPricingProvider:      spotPricingProvider,
+		instanceTopologyProvider: instanceTopologyProvider,
+		cache:                    cache.New(InstanceTypesAndZonesCacheTTL, CacheCleanupInterval),
+		unavailableOfferings:     cache.New(UnfulfillableCapacityErrorCacheTTL, CacheCleanupInterval),
 	}
 }
 
 // Get all instance type options
 func (p *InstanceTypeProvider) Get(ctx context.Context, provider *v1alpha1.AWS) ([]cloudprovider.InstanceType, error) {
+	start := time.Now()
+	defer func() { metrics.InstanceTypeGetDuration.Observe(time.Since(start).Seconds()) }()
 	p.Lock()
 	defer p.Unlock()
 	// Get InstanceTypes from EC2
@@ -79,30 +100,54 @@ func (p *InstanceTypeProvider) Get(ctx context.Context, provider *v1alpha1.AWS)
 	if err != nil {
 		return nil, err
 	}
+	// Get the ZoneType (availability-zone, local-zone, wavelength-zone) of every zone we might offer
+	zoneTypes, err := p.getZoneTypes(ctx)
+	if err != nil {
+		return nil, err
+	}
 	var result []cloudprovider.InstanceType
 	for _, i := range instanceTypes {
-		// TODO: move pricing information from the instance type down into offerings
 		instanceTypeName := aws.StringValue(i.InstanceType)
-		price, err := p.pricingProvider.OnDemandPrice(instanceTypeName)
+		onDemandPrice, err := p.pricingProvider.OnDemandPrice(instanceTypeName)
 		if err != nil {
 			// don't warn as this can occur extremely often
-			price = math.MaxFloat64
+			onDemandPrice = math.MaxFloat64
 		}
-		instanceType := NewInstanceType(ctx, i, price, provider, p.createOfferings(i, instanceTypeZones[instanceTypeName]))
+		instanceType := NewInstanceType(ctx, i, onDemandPrice, provider, p.createOfferings(i, instanceTypeZones[instanceTypeName], zoneTypes, onDemandPrice))
 		result = append(result, instanceType)
 	}
 	return result, nil
 }
 
-func (p *InstanceTypeProvider) createOfferings(instanceType *ec2.InstanceTypeInfo, zones sets.String) []cloudprovider.Offering {
+func (p *InstanceTypeProvider) createOfferings(instanceType *ec2.InstanceTypeInfo, zones sets.String, zoneTypes map[string]string, onDemandPrice float64) []cloudprovider.Offering {
 	offerings := []cloudprovider.Offering{}
+	instanceTypeName := aws.StringValue(instanceType.InstanceType)
+	var siblingZones sets.String
+	if p.instanceTopologyProvider != nil {
+		siblingZones = p.instanceTopologyProvider.SiblingZones(instanceTypeName)
+	}
 	for zone := range zones {
 		// while usage classes should be a distinct set, there's no guarantee of that
 		for capacityType := range sets.NewString(aws.StringValueSlice(instanceType.SupportedUsageClasses)...) {
 			// exclude any offerings that have recently seen an insufficient capacity error from EC2
-			if _, isUnavailable := p.unavailableOfferings.Get(UnavailableOfferingsCacheKey(*instanceType.InstanceType, zone, capacityType)); !isUnavailable {
-				offerings = append(offerings, cloudprovider.Offering{Zone: zone, CapacityType: capacityType})
+			if _, isUnavailable := p.unavailableOfferings.Get(UnavailableOfferingsCacheKey(instanceTypeName, zone, capacityType)); isUnavailable {
+				metrics.CacheRequestCount.WithLabelValues("unavailable-offerings", metrics.ResultHit).Inc()
+				continue
 			}
+			metrics.CacheRequestCount.WithLabelValues("unavailable-offerings", metrics.ResultMiss).Inc()
+			price := onDemandPrice
+			if capacityType == ec2.UsageClassTypeSpot && p.spotPricingProvider != nil {
+				if spotPrice, ok := p.spotPricingProvider.SpotPrice(instanceTypeName, zone); ok {
+					price = spotPrice
+				}
+			}
+			offerings = append(offerings, cloudprovider.Offering{
+				Zone:            zone,
+				CapacityType:    capacityType,
+				ZoneType:        zoneTypes[zone],
+				Price:           price,
+				SiblingZoneHint: siblingZones.Has(zone),
+			})
 		}
 	}
 	return offerings
@@ -115,8 +160,10 @@ func (p *InstanceTypeProvider) getInstanceTypeZones(ctx context.Context, provide
 	}
 	cacheKey := fmt.Sprintf("%s%016x", InstanceTypeZonesCacheKeyPrefix, subnetSelectorHash)
 	if cached, ok := p.cache.Get(cacheKey); ok {
+		metrics.CacheRequestCount.WithLabelValues("instance-type-zones", metrics.ResultHit).Inc()
 		return cached.(map[string]sets.String), nil
 	}
+	metrics.CacheRequestCount.WithLabelValues("instance-type-zones", metrics.ResultMiss).Inc()
 
 	// Constrain AZs from subnets
 	subnets, err := p.subnetProvider.Get(ctx, provider)
@@ -127,21 +174,26 @@ func (p *InstanceTypeProvider) getInstanceTypeZones(ctx context.Context, provide
 		return aws.StringValue(subnet.AvailabilityZone)
 	})...)
 
-	// Get offerings from EC2
+	// Get offerings from EC2, across standard Availability Zones as well as any opted-in Local
+	// Zones and Wavelength Zones that the subnet selector matched.
 	instanceTypeZones := map[string]sets.String{}
-	if err := p.ec2api.DescribeInstanceTypeOfferingsPagesWithContext(ctx, &ec2.DescribeInstanceTypeOfferingsInput{LocationType: aws.String("availability-zone")},
-		func(output *ec2.DescribeInstanceTypeOfferingsOutput, lastPage bool) bool {
-			for _, offering := range output.InstanceTypeOfferings {
-				if zones.Has(aws.StringValue(offering.Location)) {
-					if _, ok := instanceTypeZones[aws.StringValue(offering.InstanceType)]; !ok {
-						instanceTypeZones[aws.StringValue(offering.InstanceType)] = sets.NewString()
+	for _, locationType := range locationTypes {
+		if err := p.ec2api.DescribeInstanceTypeOfferingsPagesWithContext(ctx, &ec2.DescribeInstanceTypeOfferingsInput{LocationType: aws.String(locationType)},
+			func(output *ec2.DescribeInstanceTypeOfferingsOutput, lastPage bool) bool {
+				for _, offering := range output.InstanceTypeOfferings {
+					if zones.Has(aws.StringValue(offering.Location)) {
+						if _, ok := instanceTypeZones[aws.StringValue(offering.InstanceType)]; !ok {
+							instanceTypeZones[aws.StringValue(offering.InstanceType)] = sets.NewString()
+						}
+						instanceTypeZones[aws.StringValue(offering.InstanceType)].Insert(aws.StringValue(offering.Location))
 					}
-					instanceTypeZones[aws.StringValue(offering.InstanceType)].Insert(aws.StringValue(offering.Location))
 				}
-			}
-			return true
-		}); err != nil {
-		return nil, fmt.Errorf("describing instance type zone offerings, %w", err)
+				return true
+			}); err != nil {
+			metrics.APIRequestCount.WithLabelValues("DescribeInstanceTypeOfferings", apiResult(err)).Inc()
+			return nil, fmt.Errorf("describing instance type %s offerings, %w", locationType, err)
+		}
+		metrics.APIRequestCount.WithLabelValues("DescribeInstanceTypeOfferings", metrics.ResultSuccess).Inc()
 	}
 	if _, ok := instanceTypeZones["p4de.24xlarge"]; !ok && zones.Has("us-east-1d") {
 		logging.FromContext(ctx).Debugf("Forcing p4de.24xlarge in us-east-1d")
@@ -149,14 +201,91 @@ func (p *InstanceTypeProvider) getInstanceTypeZones(ctx context.Context, provide
 	}
 	logging.FromContext(ctx).Debugf("Discovered EC2 instance types zonal offerings (cache key: %v)", cacheKey)
 	p.cache.SetDefault(cacheKey, instanceTypeZones)
+	metrics.CacheEntriesGauge.WithLabelValues("instance-type-zones").Set(float64(p.cacheEntryCountWithPrefix(InstanceTypeZonesCacheKeyPrefix)))
 	return instanceTypeZones, nil
 }
 
+// cacheEntryCountWithPrefix counts the entries in the shared cache whose key starts with prefix,
+// so per-cache-name CacheEntriesGauge series report that cache's own size rather than the size of
+// the whole shared *cache.Cache (which also holds unrelated entries like InstanceTypesCacheKey and
+// ZoneTypesCacheKey).
+func (p *InstanceTypeProvider) cacheEntryCountWithPrefix(prefix string) int {
+	count := 0
+	for key := range p.cache.Items() {
+		if strings.HasPrefix(key, prefix) {
+			count++
+		}
+	}
+	return count
+}
+
+// KnownInstanceTypeZones returns the union, across every subnet selector discovered so far, of
+// instance type -> zone sets this provider has returned offerings for. SpotPricingProvider polls
+// this to know which instance-type x zone pairs it needs spot prices for.
+func (p *InstanceTypeProvider) KnownInstanceTypeZones() map[string]sets.String {
+	result := map[string]sets.String{}
+	for key, item := range p.cache.Items() {
+		if !strings.HasPrefix(key, InstanceTypeZonesCacheKeyPrefix) {
+			continue
+		}
+		zonesByInstanceType, ok := item.Object.(map[string]sets.String)
+		if !ok {
+			continue
+		}
+		for instanceType, zones := range zonesByInstanceType {
+			if _, ok := result[instanceType]; !ok {
+				result[instanceType] = sets.NewString()
+			}
+			result[instanceType] = result[instanceType].Union(zones)
+		}
+	}
+	return result
+}
+
+// ZoneType returns the previously discovered ZoneType (availability-zone, local-zone, or
+// wavelength-zone) of the given zone, for callers (e.g. node registration) that need to apply
+// ZoneTypeLabel but don't already have the full zoneTypes map getZoneTypes returns.
+func (p *InstanceTypeProvider) ZoneType(zone string) (string, bool) {
+	cached, ok := p.cache.Get(ZoneTypesCacheKey)
+	if !ok {
+		return "", false
+	}
+	zoneType, ok := cached.(map[string]string)[zone]
+	return zoneType, ok
+}
+
+// getZoneTypes resolves the ZoneType (availability-zone, local-zone, or wavelength-zone) of every
+// zone in the region via DescribeAvailabilityZones, which covers Local Zones and Wavelength Zones
+// as long as the account has opted in. The result is cached per-region since it changes rarely.
+func (p *InstanceTypeProvider) getZoneTypes(ctx context.Context) (map[string]string, error) {
+	if cached, ok := p.cache.Get(ZoneTypesCacheKey); ok {
+		metrics.CacheRequestCount.WithLabelValues("zone-types", metrics.ResultHit).Inc()
+		return cached.(map[string]string), nil
+	}
+	metrics.CacheRequestCount.WithLabelValues("zone-types", metrics.ResultMiss).Inc()
+	output, err := p.ec2api.DescribeAvailabilityZonesWithContext(ctx, &ec2.DescribeAvailabilityZonesInput{
+		AllAvailabilityZones: aws.Bool(true),
+	})
+	metrics.APIRequestCount.WithLabelValues("DescribeAvailabilityZones", apiResult(err)).Inc()
+	if err != nil {
+		return nil, fmt.Errorf("describing availability zones, %w", err)
+	}
+	zoneTypes := map[string]string{}
+	for _, zone := range output.AvailabilityZones {
+		zoneTypes[aws.StringValue(zone.ZoneName)] = aws.StringValue(zone.ZoneType)
+	}
+	logging.FromContext(ctx).Debugf("Discovered %d EC2 zone types", len(zoneTypes))
+	p.cache.SetDefault(ZoneTypesCacheKey, zoneTypes)
+	return zoneTypes, nil
+}
+
 // getInstanceTypes retrieves all instance types from the ec2 DescribeInstanceTypes API using some opinionated filters
 func (p *InstanceTypeProvider) getInstanceTypes(ctx context.Context, provider *v1alpha1.AWS) (map[string]*ec2.InstanceTypeInfo, error) {
 	if cached, ok := p.cache.Get(InstanceTypesCacheKey); ok {
+		metrics.CacheRequestCount.WithLabelValues("instance-types", metrics.ResultHit).Inc()
 		return cached.(map[string]*ec2.InstanceTypeInfo), nil
 	}
+	metrics.CacheRequestCount.WithLabelValues("instance-types", metrics.ResultMiss).Inc()
 	instanceTypes := map[string]*ec2.InstanceTypeInfo{}
 	if err := p.ec2api.DescribeInstanceTypesPagesWithContext(ctx, &ec2.DescribeInstanceTypesInput{
 		Filters: []*ec2.Filter{
@@ -177,10 +306,13 @@ func (p *InstanceTypeProvider) getInstanceTypes(ctx context.Context, provider *v
 		}
 		return true
 	}); err != nil {
+		metrics.APIRequestCount.WithLabelValues("DescribeInstanceTypes", apiResult(err)).Inc()
 		return nil, fmt.Errorf("fetching instance types using ec2.DescribeInstanceTypes, %w", err)
 	}
+	metrics.APIRequestCount.WithLabelValues("DescribeInstanceTypes", metrics.ResultSuccess).Inc()
 	logging.FromContext(ctx).Debugf("Discovered %d EC2 instance types", len(instanceTypes))
 	p.cache.SetDefault(InstanceTypesCacheKey, instanceTypes)
+	metrics.CacheEntriesGauge.WithLabelValues("instance-types").Set(float64(len(instanceTypes)))
 	return instanceTypes, nil
 }
 
@@ -199,19 +331,78 @@ func (p *InstanceTypeProvider) filter(instanceType *ec2.InstanceTypeInfo) bool {
 	return true
 }
 
+// unavailableOfferingEntry tracks how many consecutive times an offering has been reported
+// unavailable, and the error code it most recently failed with, so CacheUnavailable can grow the
+// TTL the more persistently an offering fails.
+type unavailableOfferingEntry struct {
+	errorCode string
+	count     int
+}
+
+// unavailableOfferingBackoffMultiplier controls how aggressively the TTL grows per consecutive
+// failure for a given EC2 error code. Codes that indicate a structural incompatibility (e.g.
+// Unsupported) back off much faster than transient capacity errors, since retrying sooner has no
+// chance of succeeding. SpotMaxPriceTooLow gets the same treatment as Unsupported: our spot max
+// price for an offering doesn't change between CreateFleet calls, so a retry is just as doomed
+// until something external (a price drop) changes the outcome. InsufficientInstanceCapacity is
+// the most transient of the three and decays faster than the default, since EC2 capacity shifts
+// on its own within minutes.
+var unavailableOfferingBackoffMultiplier = map[string]float64{
+	"Unsupported":                  4,
+	"SpotMaxPriceTooLow":           4,
+	"InsufficientInstanceCapacity": 1.5,
+}
+
+const defaultUnavailableOfferingBackoffMultiplier float64 = 2
+
+// unavailableOfferingTTL computes the cache TTL for the count'th consecutive failure of the
+// given error code, growing exponentially and capped at MaxUnfulfillableCapacityErrorCacheTTL.
+func unavailableOfferingTTL(errorCode string, count int) time.Duration {
+	multiplier := defaultUnavailableOfferingBackoffMultiplier
+	if m, ok := unavailableOfferingBackoffMultiplier[errorCode]; ok {
+		multiplier = m
+	}
+	ttl := time.Duration(float64(UnfulfillableCapacityErrorCacheTTL) * math.Pow(multiplier, float64(count-1)))
+	if ttl > MaxUnfulfillableCapacityErrorCacheTTL {
+		ttl = MaxUnfulfillableCapacityErrorCacheTTL
+	}
+	return ttl
+}
+
 // CacheUnavailable allows the InstanceProvider to communicate recently observed temporary capacity shortages in
-// the provided offerings
+// the provided offerings. Consecutive failures of the same offering with the same error code grow the TTL
+// exponentially, so persistently unfulfillable offerings are retried less and less often.
 func (p *InstanceTypeProvider) CacheUnavailable(ctx context.Context, fleetErr *ec2.CreateFleetError, capacityType string) {
 	instanceType := aws.StringValue(fleetErr.LaunchTemplateAndOverrides.Overrides.InstanceType)
 	zone := aws.StringValue(fleetErr.LaunchTemplateAndOverrides.Overrides.AvailabilityZone)
-	logging.FromContext(ctx).Debugf("%s for offering { instanceType: %s, zone: %s, capacityType: %s }, avoiding for %s",
-		aws.StringValue(fleetErr.ErrorCode),
+	errorCode := aws.StringValue(fleetErr.ErrorCode)
+	key := UnavailableOfferingsCacheKey(instanceType, zone, capacityType)
+
+	entry := unavailableOfferingEntry{errorCode: errorCode, count: 1}
+	if cached, ok := p.unavailableOfferings.Get(key); ok {
+		if prev := cached.(unavailableOfferingEntry); prev.errorCode == errorCode {
+			entry.count = prev.count + 1
+		}
+	}
+	ttl := unavailableOfferingTTL(errorCode, entry.count)
+	logging.FromContext(ctx).Debugf("%s (%dx) for offering { instanceType: %s, zone: %s, capacityType: %s }, avoiding for %s",
+		errorCode,
+		entry.count,
 		instanceType,
 		zone,
 		capacityType,
-		UnfulfillableCapacityErrorCacheTTL)
+		ttl)
 	// even if the key is already in the cache, we still need to call Set to extend the cached entry's TTL
-	p.unavailableOfferings.SetDefault(UnavailableOfferingsCacheKey(instanceType, zone, capacityType), struct{}{})
+	p.unavailableOfferings.Set(key, entry, ttl)
+	metrics.UnavailableOfferingsCount.WithLabelValues(capacityType, errorCode).Inc()
+	metrics.CacheEntriesGauge.WithLabelValues("unavailable-offerings").Set(float64(p.unavailableOfferings.ItemCount()))
+}
+
+// MarkAvailable clears any cached unavailability for the given offering, resetting its failure
+// count back to zero. Called from the instance provider's successful launch path once a
+// CreateFleet request actually places an instance in this offering.
+func (p *InstanceTypeProvider) MarkAvailable(instanceType, zone, capacityType string) {
+	p.unavailableOfferings.Delete(UnavailableOfferingsCacheKey(instanceType, zone, capacityType))
 }
 
 func compressInstanceType(instanceType *ec2.InstanceTypeInfo) *ec2.InstanceTypeInfo {
@@ -232,6 +423,19 @@ func compressInstanceType(instanceType *ec2.InstanceTypeInfo) *ec2.InstanceTypeI
 	}
 }
 
+// apiResult classifies an EC2 API error for the metrics.APIRequestCount "result" label,
+// distinguishing throttling from other errors since throttling is actionable (back off) rather
+// than a sign of a broken request.
+func apiResult(err error) string {
+	if err == nil {
+		return metrics.ResultSuccess
+	}
+	if awsErr, ok := err.(awserr.Error); ok && (awsErr.Code() == "RequestLimitExceeded" || awsErr.Code() == "Throttling") {
+		return metrics.ResultThrottled
+	}
+	return metrics.ResultError
+}
+
 func UnavailableOfferingsCacheKey(instanceType string, zone string, capacityType string) string {
 	return fmt.Sprintf("%s:%s:%s", capacityType, instanceType, zone)
 }
@@ -0,0 +1,105 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aws
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+
+	"github.com/aws/karpenter/pkg/cloudprovider/aws/metrics"
+)
+
+func TestApiResult(t *testing.T) {
+	cases := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"nil error is success", nil, metrics.ResultSuccess},
+		{"RequestLimitExceeded is throttled", awserr.New("RequestLimitExceeded", "slow down", nil), metrics.ResultThrottled},
+		{"Throttling is throttled", awserr.New("Throttling", "slow down", nil), metrics.ResultThrottled},
+		{"other aws error is error", awserr.New("UnsupportedOperation", "nope", nil), metrics.ResultError},
+		{"non-aws error is error", errors.New("boom"), metrics.ResultError},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := apiResult(c.err); got != c.want {
+				t.Errorf("apiResult(%v) = %q, want %q", c.err, got, c.want)
+			}
+		})
+	}
+}
+
+func TestUnavailableOfferingTTL(t *testing.T) {
+	cases := []struct {
+		name      string
+		errorCode string
+		count     int
+		want      time.Duration
+	}{
+		{"default multiplier, first failure", "InsufficientCapacity", 1, UnfulfillableCapacityErrorCacheTTL},
+		{"default multiplier grows geometrically", "InsufficientCapacity", 3, time.Duration(float64(UnfulfillableCapacityErrorCacheTTL) * 4)},
+		{"Unsupported backs off faster than default", "Unsupported", 2, UnfulfillableCapacityErrorCacheTTL * 4},
+		{"SpotMaxPriceTooLow backs off as fast as Unsupported", "SpotMaxPriceTooLow", 2, UnfulfillableCapacityErrorCacheTTL * 4},
+		{"InsufficientInstanceCapacity decays faster than default", "InsufficientInstanceCapacity", 2, time.Duration(float64(UnfulfillableCapacityErrorCacheTTL) * 1.5)},
+		{"capped at MaxUnfulfillableCapacityErrorCacheTTL", "Unsupported", 10, MaxUnfulfillableCapacityErrorCacheTTL},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := unavailableOfferingTTL(c.errorCode, c.count); got != c.want {
+				t.Errorf("unavailableOfferingTTL(%q, %d) = %s, want %s", c.errorCode, c.count, got, c.want)
+			}
+		})
+	}
+}
+
+func TestCacheUnavailableThenMarkAvailable(t *testing.T) {
+	p := NewInstanceTypeProvider(nil, nil, nil, nil, nil)
+	fleetErr := &ec2.CreateFleetError{
+		ErrorCode: aws.String("InsufficientInstanceCapacity"),
+		LaunchTemplateAndOverrides: &ec2.LaunchTemplateAndOverridesResponse{
+			Overrides: &ec2.FleetLaunchTemplateOverrides{
+				InstanceType:     aws.String("m5.large"),
+				AvailabilityZone: aws.String("us-east-1a"),
+			},
+		},
+	}
+	key := UnavailableOfferingsCacheKey("m5.large", "us-east-1a", ec2.UsageClassTypeOnDemand)
+
+	p.CacheUnavailable(context.Background(), fleetErr, ec2.UsageClassTypeOnDemand)
+	if _, ok := p.unavailableOfferings.Get(key); !ok {
+		t.Fatalf("expected offering to be cached unavailable after CacheUnavailable")
+	}
+
+	p.CacheUnavailable(context.Background(), fleetErr, ec2.UsageClassTypeOnDemand)
+	cached, ok := p.unavailableOfferings.Get(key)
+	if !ok {
+		t.Fatalf("expected offering to still be cached unavailable after a second failure")
+	}
+	if entry := cached.(unavailableOfferingEntry); entry.count != 2 {
+		t.Errorf("expected consecutive failure count to grow to 2, got %d", entry.count)
+	}
+
+	p.MarkAvailable("m5.large", "us-east-1a", ec2.UsageClassTypeOnDemand)
+	if _, ok := p.unavailableOfferings.Get(key); ok {
+		t.Errorf("expected MarkAvailable to clear the cached unavailability")
+	}
+}
@@ -0,0 +1,94 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package metrics registers the Prometheus collectors used to instrument the AWS cloudprovider's
+// EC2-backed providers (instance types, pricing, subnets), so operators can see why the
+// provisioner can't find capacity without having to read debug logs.
+package metrics
+
+import "github.com/prometheus/client_golang/prometheus"
+
+const (
+	namespace = "karpenter"
+	subsystem = "cloudprovider_aws"
+)
+
+var (
+	// APIRequestCount counts calls made to EC2 describe APIs, labeled by the API name and
+	// whether the call succeeded, errored, or was throttled.
+	APIRequestCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "api_requests_total",
+		Help:      "Count of EC2 API requests made by the cloudprovider, labeled by api and result.",
+	}, []string{"api", "result"})
+
+	// CacheEntriesGauge reports the number of entries currently held in a named cache.
+	CacheEntriesGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "cache_entries",
+		Help:      "Number of entries currently held in a provider cache, labeled by cache name.",
+	}, []string{"cache"})
+
+	// CacheRequestCount counts cache lookups, labeled by cache name and whether they hit or missed.
+	CacheRequestCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "cache_requests_total",
+		Help:      "Count of cache lookups, labeled by cache name and hit/miss.",
+	}, []string{"cache", "result"})
+
+	// UnavailableOfferingsCount counts every CacheUnavailable invocation, labeled by capacity type
+	// and the EC2 error code that caused it. Deliberately excludes instance_type and zone: unlike
+	// the other label sets in this file, those two are open-ended (new instance types ship
+	// regularly, and Local/Wavelength Zone opt-ins add zones), and crossed with every error code
+	// during a large capacity-constrained scale-up they'd mint thousands of permanent series. Use
+	// CacheEntriesGauge's "unavailable-offerings" series for overall volume, and the debug log
+	// line in CacheUnavailable when you need the specific instance type/zone.
+	UnavailableOfferingsCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "unavailable_offerings_total",
+		Help:      "Count of offerings reported unavailable, labeled by capacity type and error code.",
+	}, []string{"capacity_type", "error_code"})
+
+	// InstanceTypeGetDuration times InstanceTypeProvider.Get end-to-end.
+	InstanceTypeGetDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "instance_type_get_duration_seconds",
+		Help:      "Latency of InstanceTypeProvider.Get calls.",
+		Buckets:   prometheus.DefBuckets,
+	})
+)
+
+func init() {
+	prometheus.MustRegister(
+		APIRequestCount,
+		CacheEntriesGauge,
+		CacheRequestCount,
+		UnavailableOfferingsCount,
+		InstanceTypeGetDuration,
+	)
+}
+
+// Result labels used with APIRequestCount and CacheRequestCount.
+const (
+	ResultSuccess   = "success"
+	ResultError     = "error"
+	ResultThrottled = "throttled"
+	ResultHit       = "hit"
+	ResultMiss      = "miss"
+)
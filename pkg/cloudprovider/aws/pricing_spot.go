@@ -0,0 +1,201 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aws
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"knative.dev/pkg/logging"
+
+	"github.com/aws/karpenter/pkg/cloudprovider/aws/metrics"
+)
+
+const (
+	// DefaultSpotPriceUpdateInterval is used when a provisioner doesn't configure one.
+	DefaultSpotPriceUpdateInterval = 15 * time.Minute
+	// spotPricingUpdateConcurrency bounds the number of concurrent DescribeSpotPriceHistory calls
+	// made on each poll, so a region with many instance types doesn't overwhelm the EC2 API.
+	spotPricingUpdateConcurrency = 20
+	// spotPriceHistoryLookback is how far back we ask DescribeSpotPriceHistory to look. EC2 only
+	// publishes a new price point every few hours per zone, so a StartTime of "now" with no
+	// EndTime returns nothing on almost every poll; looking back gives the most recent published
+	// price a window to fall into.
+	spotPriceHistoryLookback = 1 * time.Hour
+)
+
+// SpotPricingProvider periodically refreshes the most recent EC2 spot price for every
+// instance-type x availability-zone pair that InstanceTypeProvider has discovered offerings for,
+// so that spot offerings can be priced independently per zone rather than sharing a single
+// per-instance-type price.
+type SpotPricingProvider struct {
+	ec2api         ec2iface.EC2API
+	updateInterval time.Duration
+
+	mu sync.RWMutex
+	// prices maps instanceType -> zone -> most recently observed spot price
+	prices map[string]map[string]float64
+}
+
+// NewSpotPricingProvider constructs a SpotPricingProvider. A zero updateInterval defaults to
+// DefaultSpotPriceUpdateInterval.
+func NewSpotPricingProvider(ec2api ec2iface.EC2API, updateInterval time.Duration) *SpotPricingProvider {
+	if updateInterval <= 0 {
+		updateInterval = DefaultSpotPriceUpdateInterval
+	}
+	return &SpotPricingProvider{
+		ec2api:         ec2api,
+		updateInterval: updateInterval,
+		prices:         map[string]map[string]float64{},
+	}
+}
+
+// SpotPrice returns the most recently observed spot price for the given instance type in the
+// given zone.
+func (p *SpotPricingProvider) SpotPrice(instanceType, zone string) (float64, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	zones, ok := p.prices[instanceType]
+	if !ok {
+		metrics.CacheRequestCount.WithLabelValues("spot-prices", metrics.ResultMiss).Inc()
+		return 0, false
+	}
+	price, ok := zones[zone]
+	if !ok {
+		metrics.CacheRequestCount.WithLabelValues("spot-prices", metrics.ResultMiss).Inc()
+		return 0, false
+	}
+	metrics.CacheRequestCount.WithLabelValues("spot-prices", metrics.ResultHit).Inc()
+	return price, true
+}
+
+// Start launches a goroutine that polls DescribeSpotPriceHistory for the instance-type x zone
+// pairs returned by instanceTypeZones every updateInterval, until ctx is done.
+func (p *SpotPricingProvider) Start(ctx context.Context, instanceTypeZones func() map[string]sets.String) {
+	go func() {
+		ticker := time.NewTicker(p.updateInterval)
+		defer ticker.Stop()
+		for {
+			p.updatePrices(ctx, instanceTypeZones())
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// updatePrices fans out a bounded number of concurrent DescribeSpotPriceHistory calls, one per
+// instance type, then merges the results into the price table under lock. An instance type that
+// fails to refresh this cycle (e.g. it's persistently throttled or unsupported) is logged and
+// skipped rather than aborting the whole poll; its previous price, if any, is left in place.
+// Instance types no longer present in instanceTypeZones at all (the subnet selector changed, the
+// region stopped offering them, ...) are pruned instead,
+// so the table doesn't grow unbounded over the controller's lifetime with stale prices nothing
+// will ever look up again.
+func (p *SpotPricingProvider) updatePrices(ctx context.Context, instanceTypeZones map[string]sets.String) {
+	updated := map[string]map[string]float64{}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, spotPricingUpdateConcurrency)
+
+	for instanceType, zones := range instanceTypeZones {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(instanceType string, zones sets.String) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			prices, err := p.describeSpotPriceHistoryWithBackoff(ctx, instanceType, zones)
+			if err != nil {
+				logging.FromContext(ctx).Errorf("describing spot price history for %s, %s", instanceType, err)
+				return
+			}
+			mu.Lock()
+			updated[instanceType] = prices
+			mu.Unlock()
+		}(instanceType, zones)
+	}
+	wg.Wait()
+
+	p.mu.Lock()
+	for instanceType := range p.prices {
+		if _, ok := instanceTypeZones[instanceType]; !ok {
+			delete(p.prices, instanceType)
+		}
+	}
+	for instanceType, prices := range updated {
+		p.prices[instanceType] = prices
+	}
+	entries := len(p.prices)
+	p.mu.Unlock()
+	metrics.CacheEntriesGauge.WithLabelValues("spot-prices").Set(float64(entries))
+	logging.FromContext(ctx).Debugf("Updated spot prices for %d of %d instance types", len(updated), len(instanceTypeZones))
+}
+
+// describeSpotPriceHistoryWithBackoff queries the most recent spot price per zone for a single
+// instance type, retrying with exponential backoff if EC2 throttles the request.
+func (p *SpotPricingProvider) describeSpotPriceHistoryWithBackoff(ctx context.Context, instanceType string, zones sets.String) (map[string]float64, error) {
+	input := &ec2.DescribeSpotPriceHistoryInput{
+		InstanceTypes:       []*string{aws.String(instanceType)},
+		ProductDescriptions: []*string{aws.String("Linux/UNIX")},
+		StartTime:           aws.Time(time.Now().Add(-spotPriceHistoryLookback)),
+	}
+	prices := map[string]float64{}
+	backoff := 1 * time.Second
+	for attempt := 0; ; attempt++ {
+		err := p.ec2api.DescribeSpotPriceHistoryPagesWithContext(ctx, input, func(output *ec2.DescribeSpotPriceHistoryOutput, lastPage bool) bool {
+			for _, entry := range output.SpotPriceHistory {
+				zone := aws.StringValue(entry.AvailabilityZone)
+				if !zones.Has(zone) {
+					continue
+				}
+				// entries come back most-recent-first per zone; only keep the first we see
+				if _, seen := prices[zone]; seen {
+					continue
+				}
+				price, parseErr := strconv.ParseFloat(aws.StringValue(entry.SpotPrice), 64)
+				if parseErr != nil {
+					continue
+				}
+				prices[zone] = price
+			}
+			return true
+		})
+		if err == nil {
+			metrics.APIRequestCount.WithLabelValues("DescribeSpotPriceHistory", metrics.ResultSuccess).Inc()
+			return prices, nil
+		}
+		awsErr, ok := err.(awserr.Error)
+		if !ok || (awsErr.Code() != "RequestLimitExceeded" && awsErr.Code() != "Throttling") || attempt >= 5 {
+			metrics.APIRequestCount.WithLabelValues("DescribeSpotPriceHistory", metrics.ResultError).Inc()
+			return nil, err
+		}
+		metrics.APIRequestCount.WithLabelValues("DescribeSpotPriceHistory", metrics.ResultThrottled).Inc()
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
@@ -0,0 +1,147 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aws
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/mitchellh/hashstructure/v2"
+	"github.com/patrickmn/go-cache"
+	"knative.dev/pkg/logging"
+
+	"github.com/aws/karpenter/pkg/cloudprovider/aws/apis/v1alpha1"
+	"github.com/aws/karpenter/pkg/cloudprovider/aws/metrics"
+)
+
+const (
+	SubnetsCacheKeyPrefix = "subnets:"
+	SubnetsCacheTTL       = 5 * time.Minute
+)
+
+// SubnetProvider resolves the subnets matched by a provisioner's subnet selector.
+type SubnetProvider struct {
+	sync.Mutex
+	ec2api ec2iface.EC2API
+	cache  *cache.Cache
+}
+
+func NewSubnetProvider(ec2api ec2iface.EC2API) *SubnetProvider {
+	return &SubnetProvider{
+		ec2api: ec2api,
+		cache:  cache.New(SubnetsCacheTTL, CacheCleanupInterval),
+	}
+}
+
+// Get returns the subnets matching the provider's subnet selector tags.
+func (p *SubnetProvider) Get(ctx context.Context, provider *v1alpha1.AWS) ([]*ec2.Subnet, error) {
+	p.Lock()
+	defer p.Unlock()
+	subnetSelectorHash, err := hashstructure.Hash(provider.SubnetSelector, hashstructure.FormatV2, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash the subnet selector: %w", err)
+	}
+	cacheKey := fmt.Sprintf("%s%016x", SubnetsCacheKeyPrefix, subnetSelectorHash)
+	if cached, ok := p.cache.Get(cacheKey); ok {
+		metrics.CacheRequestCount.WithLabelValues("subnets", metrics.ResultHit).Inc()
+		return cached.([]*ec2.Subnet), nil
+	}
+	metrics.CacheRequestCount.WithLabelValues("subnets", metrics.ResultMiss).Inc()
+
+	var filters []*ec2.Filter
+	for key, value := range provider.SubnetSelector {
+		if value == "*" {
+			filters = append(filters, &ec2.Filter{Name: aws.String("tag-key"), Values: []*string{aws.String(key)}})
+			continue
+		}
+		filters = append(filters, &ec2.Filter{Name: aws.String(fmt.Sprintf("tag:%s", key)), Values: []*string{aws.String(value)}})
+	}
+	var subnets []*ec2.Subnet
+	if err := p.ec2api.DescribeSubnetsPagesWithContext(ctx, &ec2.DescribeSubnetsInput{Filters: filters},
+		func(output *ec2.DescribeSubnetsOutput, lastPage bool) bool {
+			subnets = append(subnets, output.Subnets...)
+			return true
+		}); err != nil {
+		metrics.APIRequestCount.WithLabelValues("DescribeSubnets", apiResult(err)).Inc()
+		return nil, fmt.Errorf("describing subnets, %w", err)
+	}
+	metrics.APIRequestCount.WithLabelValues("DescribeSubnets", metrics.ResultSuccess).Inc()
+	logging.FromContext(ctx).Debugf("Discovered %d subnets (cache key: %v)", len(subnets), cacheKey)
+	p.warnUnreachableSubnets(ctx, subnets)
+	p.cache.SetDefault(cacheKey, subnets)
+	metrics.CacheEntriesGauge.WithLabelValues("subnets").Set(float64(p.cache.ItemCount()))
+	return subnets, nil
+}
+
+// warnUnreachableSubnets looks up the route table explicitly associated with each subnet and logs
+// a warning for any such subnet with no route off-VPC at all; subnets without an explicit route
+// table association are not checked. Opted-in Wavelength Zone subnets route out via a
+// Carrier Gateway (cagw-*) rather than an Internet or NAT Gateway, so they're recognized here
+// rather than being misreported as unreachable.
+func (p *SubnetProvider) warnUnreachableSubnets(ctx context.Context, subnets []*ec2.Subnet) {
+	subnetIDs := make([]*string, 0, len(subnets))
+	for _, subnet := range subnets {
+		subnetIDs = append(subnetIDs, subnet.SubnetId)
+	}
+	output, err := p.ec2api.DescribeRouteTablesWithContext(ctx, &ec2.DescribeRouteTablesInput{
+		Filters: []*ec2.Filter{{Name: aws.String("association.subnet-id"), Values: subnetIDs}},
+	})
+	metrics.APIRequestCount.WithLabelValues("DescribeRouteTables", apiResult(err)).Inc()
+	if err != nil {
+		logging.FromContext(ctx).Debugf("Unable to describe route tables for reachability check, %s", err)
+		return
+	}
+	routeTableBySubnet := map[string]*ec2.RouteTable{}
+	for _, routeTable := range output.RouteTables {
+		for _, assoc := range routeTable.Associations {
+			if assoc.SubnetId != nil {
+				routeTableBySubnet[aws.StringValue(assoc.SubnetId)] = routeTable
+			}
+		}
+	}
+	for _, subnet := range subnets {
+		routeTable, ok := routeTableBySubnet[aws.StringValue(subnet.SubnetId)]
+		if !ok || routeTableHasInternetRoute(routeTable) {
+			continue
+		}
+		logging.FromContext(ctx).Warnf("Subnet %s has no route to the internet or a carrier gateway", aws.StringValue(subnet.SubnetId))
+	}
+}
+
+// routeTableHasInternetRoute reports whether a route table gives its subnet a path off-VPC.
+// Most subnets reach the internet via an Internet Gateway (igw-*) or NAT Gateway; Wavelength
+// Zone subnets instead reach the carrier network via a Carrier Gateway (cagw-*), which previously
+// wasn't recognized here, so opted-in Wavelength subnets were incorrectly treated as having no
+// route out.
+func routeTableHasInternetRoute(routeTable *ec2.RouteTable) bool {
+	for _, route := range routeTable.Routes {
+		if aws.StringValue(route.GatewayId) != "" && strings.HasPrefix(aws.StringValue(route.GatewayId), "igw-") {
+			return true
+		}
+		if aws.StringValue(route.NatGatewayId) != "" {
+			return true
+		}
+		if aws.StringValue(route.CarrierGatewayId) != "" {
+			return true
+		}
+	}
+	return false
+}
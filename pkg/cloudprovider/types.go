@@ -0,0 +1,41 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cloudprovider
+
+const (
+	// ZoneTypeAvailabilityZone is the ZoneType of a standard, non-edge EC2 Availability Zone.
+	ZoneTypeAvailabilityZone = "availability-zone"
+	// ZoneTypeLocalZone is the ZoneType of an AWS Local Zone.
+	ZoneTypeLocalZone = "local-zone"
+	// ZoneTypeWavelengthZone is the ZoneType of an AWS Wavelength Zone.
+	ZoneTypeWavelengthZone = "wavelength-zone"
+)
+
+// Offering describes where (Zone) and how (CapacityType) an InstanceType can be purchased, and
+// at what Price. A spot offering in one zone can be priced differently than the same instance
+// type's spot offering in another zone, so Price is tracked per-offering rather than per-type.
+type Offering struct {
+	CapacityType string
+	Zone         string
+	// ZoneType is one of ZoneTypeAvailabilityZone, ZoneTypeLocalZone, or ZoneTypeWavelengthZone,
+	// and lets provisioners require or exclude edge zones.
+	ZoneType string
+	Price    float64
+	// SiblingZoneHint is true when a recently launched instance of this InstanceType landed in
+	// Zone, on any EC2 rack-level network node. It's a topology-aware
+	// bin-packing hint: all else equal, a scheduler should prefer an offering with this set over
+	// one without it, since it's more likely to land new instances next to their siblings.
+	SiblingZoneHint bool
+}